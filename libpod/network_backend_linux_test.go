@@ -0,0 +1,117 @@
+// +build linux
+
+package libpod
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cri-o/ocicni/pkg/ocicni"
+)
+
+// These tests check that buildPodNetwork (the CNI backend's request
+// construction) and buildNetavarkConfig (netavark's) agree on what a given
+// set of aliases, static IP/MAC, and multi-network attach options mean,
+// since both are supposed to produce equivalent network setup requests for
+// the same container regardless of which backend is selected. Neither
+// function needs a live Container or Runtime, so these run against the two
+// request builders directly.
+
+func TestBuildPodNetworkAndNetavarkConfigAgreeOnNetworks(t *testing.T) {
+	ports := []ocicni.PortMapping{{Protocol: "tcp", HostPort: 8080, ContainerPort: 80}}
+
+	cases := []struct {
+		name     string
+		networks []string
+	}{
+		{name: "default network only", networks: nil},
+		{name: "single named network", networks: []string{"net0"}},
+		{name: "multi-network attach", networks: []string{"net0", "net1", "net2"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			podNetwork := buildPodNetwork("id", "name", "/tmp/netns", tc.networks, ports, nil, nil, nil, "default")
+			netavarkCfg := buildNetavarkConfig("id", "name", "/tmp/netns", tc.networks, ports, nil, nil, nil, nil)
+
+			wantCount := len(tc.networks)
+			if gotCNI := len(podNetwork.Networks); gotCNI != wantCount {
+				t.Errorf("cni backend: got %d attached networks, want %d", gotCNI, wantCount)
+			}
+			if gotNetavark := len(netavarkCfg.Networks); gotNetavark != wantCount {
+				t.Errorf("netavark backend: got %d attached networks, want %d", gotNetavark, wantCount)
+			}
+			for i, name := range tc.networks {
+				if podNetwork.Networks[i].Name != name {
+					t.Errorf("cni backend: network %d = %q, want %q", i, podNetwork.Networks[i].Name, name)
+				}
+				if netavarkCfg.Networks[i] != name {
+					t.Errorf("netavark backend: network %d = %q, want %q", i, netavarkCfg.Networks[i], name)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPodNetworkAndNetavarkConfigAgreeOnAliases(t *testing.T) {
+	aliases := []string{"web", "web.local"}
+
+	podNetwork := buildPodNetwork("id", "name", "/tmp/netns", []string{"net0"}, nil, nil, nil, nil, "default")
+	podNetwork.Aliases = aliases // set the way cniNetworkBackend.Setup does after building the request
+	netavarkCfg := buildNetavarkConfig("id", "name", "/tmp/netns", []string{"net0"}, nil, aliases, nil, nil, nil)
+
+	if len(podNetwork.Aliases) != len(aliases) {
+		t.Fatalf("cni backend: got %d aliases, want %d", len(podNetwork.Aliases), len(aliases))
+	}
+	if len(netavarkCfg.Aliases) != len(aliases) {
+		t.Fatalf("netavark backend: got %d aliases, want %d", len(netavarkCfg.Aliases), len(aliases))
+	}
+	for i, alias := range aliases {
+		if podNetwork.Aliases[i] != alias {
+			t.Errorf("cni backend: alias %d = %q, want %q", i, podNetwork.Aliases[i], alias)
+		}
+		if netavarkCfg.Aliases[i] != alias {
+			t.Errorf("netavark backend: alias %d = %q, want %q", i, netavarkCfg.Aliases[i], alias)
+		}
+	}
+}
+
+func TestBuildPodNetworkAndNetavarkConfigAgreeOnStaticIPAndMAC(t *testing.T) {
+	staticIP := net.ParseIP("10.0.0.5")
+	staticIP6 := net.ParseIP("fd00::5")
+	staticMAC, err := net.ParseMAC("02:42:ac:11:00:05")
+	if err != nil {
+		t.Fatalf("ParseMAC: %v", err)
+	}
+
+	podNetwork := buildPodNetwork("id", "name", "/tmp/netns", nil, nil, staticIP, staticIP6, staticMAC, "default")
+	netavarkCfg := buildNetavarkConfig("id", "name", "/tmp/netns", nil, nil, nil, staticIP, staticIP6, staticMAC)
+
+	// buildPodNetwork has to fall back to requesting the default network
+	// explicitly once a static IP or MAC is requested, since ocicni's
+	// RuntimeConfig is keyed by network name.
+	if len(podNetwork.Networks) != 1 || podNetwork.Networks[0].Name != "default" {
+		t.Fatalf("cni backend: expected the default network to be requested explicitly, got %+v", podNetwork.Networks)
+	}
+	rt, ok := podNetwork.RuntimeConfig["default"]
+	if !ok {
+		t.Fatalf("cni backend: expected a RuntimeConfig entry for the default network")
+	}
+	wantIP := staticIP.String() + "," + staticIP6.String()
+	if rt.IP != wantIP {
+		t.Errorf("cni backend: RuntimeConfig.IP = %q, want %q", rt.IP, wantIP)
+	}
+	if rt.MAC != staticMAC.String() {
+		t.Errorf("cni backend: RuntimeConfig.MAC = %q, want %q", rt.MAC, staticMAC.String())
+	}
+
+	if netavarkCfg.StaticIP != staticIP.String() {
+		t.Errorf("netavark backend: StaticIP = %q, want %q", netavarkCfg.StaticIP, staticIP.String())
+	}
+	if netavarkCfg.StaticIP6 != staticIP6.String() {
+		t.Errorf("netavark backend: StaticIP6 = %q, want %q", netavarkCfg.StaticIP6, staticIP6.String())
+	}
+	if netavarkCfg.StaticMAC != staticMAC.String() {
+		t.Errorf("netavark backend: StaticMAC = %q, want %q", netavarkCfg.StaticMAC, staticMAC.String())
+	}
+}
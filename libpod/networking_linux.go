@@ -3,9 +3,9 @@
 package libpod
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -32,14 +32,22 @@ import (
 )
 
 // Get an OCICNI network config
-func (r *Runtime) getPodNetwork(id, name, nsPath string, networks []string, ports []ocicni.PortMapping, staticIP net.IP, staticMAC net.HardwareAddr) ocicni.PodNetwork {
+func (r *Runtime) getPodNetwork(id, name, nsPath string, networks []string, ports []ocicni.PortMapping, staticIP net.IP, staticIP6 net.IP, staticMAC net.HardwareAddr) ocicni.PodNetwork {
+	return buildPodNetwork(id, name, nsPath, networks, ports, staticIP, staticIP6, staticMAC, r.netPlugin.GetDefaultNetworkName())
+}
+
+// buildPodNetwork is the pure core of getPodNetwork: everything getPodNetwork
+// does that doesn't need a live Runtime, split out so the CNI backend's
+// request-construction logic can be parity-tested against the netavark
+// backend's buildNetavarkConfig.
+func buildPodNetwork(id, name, nsPath string, networks []string, ports []ocicni.PortMapping, staticIP net.IP, staticIP6 net.IP, staticMAC net.HardwareAddr, defaultNetworkName string) ocicni.PodNetwork {
 	var networkKey string
 	if len(networks) > 0 {
 		// This is inconsistent for >1 network, but it's probably the
 		// best we can do.
 		networkKey = networks[0]
 	} else {
-		networkKey = r.netPlugin.GetDefaultNetworkName()
+		networkKey = defaultNetworkName
 	}
 	network := ocicni.PodNetwork{
 		Name:      name,
@@ -59,7 +67,7 @@ func (r *Runtime) getPodNetwork(id, name, nsPath string, networks []string, port
 		}
 	}
 
-	if staticIP != nil || staticMAC != nil {
+	if staticIP != nil || staticIP6 != nil || staticMAC != nil {
 		// For static IP or MAC, we need to populate networks even if
 		// it's just the default.
 		if len(networks) == 0 {
@@ -68,8 +76,15 @@ func (r *Runtime) getPodNetwork(id, name, nsPath string, networks []string, port
 			network.Networks = []ocicni.NetAttachment{{Name: networkKey}}
 		}
 		var rt ocicni.RuntimeConfig = ocicni.RuntimeConfig{PortMappings: ports}
-		if staticIP != nil {
+		// ocicni's RuntimeConfig.IP takes a comma-separated list of IPs, so a
+		// dual-stack request is expressed as "<v4>,<v6>".
+		switch {
+		case staticIP != nil && staticIP6 != nil:
+			rt.IP = staticIP.String() + "," + staticIP6.String()
+		case staticIP != nil:
 			rt.IP = staticIP.String()
+		case staticIP6 != nil:
+			rt.IP = staticIP6.String()
 		}
 		if staticMAC != nil {
 			rt.MAC = staticMAC.String()
@@ -82,57 +97,73 @@ func (r *Runtime) getPodNetwork(id, name, nsPath string, networks []string, port
 	return network
 }
 
-// Create and configure a new network namespace for a container
-func (r *Runtime) configureNetNS(ctr *Container, ctrNS ns.NetNS) ([]*cnitypes.Result, error) {
-	var requestedIP net.IP
+// staticIP6 returns the persisted static IPv6 address configured for ctr via
+// the `static_ip6` network option. IPv6 was added well after StaticIP/
+// StaticMAC became dedicated ContainerConfig fields, so it piggybacks on the
+// same NetworkOptions map port_handler/slirp4netns/network_backend already
+// use for newer, per-container knobs instead of requiring its own field.
+func staticIP6(ctr *Container) (net.IP, error) {
+	if ctr.config.NetworkOptions == nil {
+		return nil, nil
+	}
+	for _, o := range ctr.config.NetworkOptions["static_ip6"] {
+		ip := net.ParseIP(o)
+		if ip == nil {
+			return nil, errors.Errorf("invalid static_ip6 %q", o)
+		}
+		if ip.To4() != nil {
+			return nil, errors.Errorf("static_ip6 %q is not an IPv6 address", o)
+		}
+		return ip, nil
+	}
+	return nil, nil
+}
+
+// requestedNetworkConfig returns the static IPv4/IPv6 and MAC addresses that
+// should be used for ctr's next network setup, preferring a one-shot request
+// over the addresses baked into the container's config and clearing the
+// one-shot request so it isn't reused the next time the container starts.
+func requestedNetworkConfig(ctr *Container) (net.IP, net.IP, net.HardwareAddr, error) {
+	requestedIP := ctr.config.StaticIP
 	if ctr.requestedIP != nil {
 		requestedIP = ctr.requestedIP
 		// cancel request for a specific IP in case the container is reused later
 		ctr.requestedIP = nil
-	} else {
-		requestedIP = ctr.config.StaticIP
 	}
 
-	var requestedMAC net.HardwareAddr
+	requestedIP6, err := staticIP6(ctr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ip6 := takeRequestedIP6(ctr); ip6 != nil {
+		requestedIP6 = ip6
+	}
+
+	requestedMAC := ctr.config.StaticMAC
 	if ctr.requestedMAC != nil {
 		requestedMAC = ctr.requestedMAC
 		// cancel request for a specific MAC in case the container is reused later
 		ctr.requestedMAC = nil
-	} else {
-		requestedMAC = ctr.config.StaticMAC
 	}
 
-	podName := getCNIPodName(ctr)
+	return requestedIP, requestedIP6, requestedMAC, nil
+}
 
-	podNetwork := r.getPodNetwork(ctr.ID(), podName, ctrNS.Path(), ctr.config.Networks, ctr.config.PortMappings, requestedIP, requestedMAC)
-	aliases, err := ctr.runtime.state.GetAllNetworkAliases(ctr)
+// Create and configure a new network namespace for a container
+func (r *Runtime) configureNetNS(ctr *Container, ctrNS ns.NetNS) ([]*cnitypes.Result, error) {
+	backend, err := r.getNetworkBackend(ctr)
 	if err != nil {
 		return nil, err
 	}
-	if len(aliases) > 0 {
-		podNetwork.Aliases = aliases
-	}
 
-	results, err := r.netPlugin.SetUpPod(podNetwork)
+	results, err := backend.Setup(ctr, ctrNS.Path())
 	if err != nil {
-		return nil, errors.Wrapf(err, "error configuring network namespace for container %s", ctr.ID())
+		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			if err2 := r.netPlugin.TearDownPod(podNetwork); err2 != nil {
-				logrus.Errorf("Error tearing down partially created network namespace for container %s: %v", ctr.ID(), err2)
-			}
-		}
-	}()
 
-	networkStatus := make([]*cnitypes.Result, 0)
-	for idx, r := range results {
-		logrus.Debugf("[%d] CNI result: %v", idx, r.Result)
-		resultCurrent, err := cnitypes.GetResult(r.Result)
-		if err != nil {
-			return nil, errors.Wrapf(err, "error parsing CNI plugin result %q: %v", r.Result, err)
-		}
-		networkStatus = append(networkStatus, resultCurrent)
+	networkStatus := make([]*cnitypes.Result, 0, len(results))
+	for _, res := range results {
+		networkStatus = append(networkStatus, res.Result)
 	}
 
 	return networkStatus, nil
@@ -187,6 +218,153 @@ type slirp4netnsCmd struct {
 	Args    slirp4netnsCmdArg `json:"arguments"`
 }
 
+// RootlessPortForwarder manages the forwarding of ports published by a
+// rootless container into the host network namespace. Implementations use
+// different mechanisms (an in-process RootlessKit-style builtin forwarder,
+// slirp4netns' own hostfwd API, or a socat fallback) and are selected based
+// on the container's `port_handler` network option and on what the
+// available binaries actually support.
+type RootlessPortForwarder interface {
+	// Setup starts forwarding every port mapping currently configured on
+	// the container.
+	Setup(ctr *Container, netnsPath string) error
+	// Teardown stops forwarding and releases any resources the forwarder
+	// holds (processes, sockets, log files).
+	Teardown() error
+	// AddMapping starts forwarding a single additional port mapping on an
+	// already-running forwarder.
+	AddMapping(pm ocicni.PortMapping) error
+	// RemoveMapping stops forwarding a single port mapping on an
+	// already-running forwarder.
+	RemoveMapping(pm ocicni.PortMapping) error
+}
+
+// rlkFeatures records what the builtin RootlessKit-style port forwarder
+// supports in the current environment.
+type rlkFeatures struct {
+	HasBuiltinDriver bool
+}
+
+// checkRLKFeatures probes whether the builtin (in-process) RootlessKit port
+// driver can be used instead of exec'ing a helper binary. Today this is
+// always supported on Linux, but the probe exists so the selection logic in
+// choosePortForwarder has a single place to extend if that ever changes
+// (e.g. a kernel missing SOCK_SEQPACKET support for AF_UNIX).
+func checkRLKFeatures() *rlkFeatures {
+	return &rlkFeatures{HasBuiltinDriver: true}
+}
+
+// choosePortForwarder selects the RootlessPortForwarder to use for ctr,
+// honoring an explicit `port_handler` network option ("rootlesskit" or
+// "socat") and otherwise probing for the builtin RootlessKit driver, with
+// socat as the last resort. It never returns a slirpPortForwarder: that one
+// is chosen by setupSlirp4netns from the slirp4netns `port_handler` option.
+func choosePortForwarder(ctr *Container) (RootlessPortForwarder, error) {
+	handler := ""
+	if ctr.config.NetworkOptions != nil {
+		for _, o := range ctr.config.NetworkOptions["port_handler"] {
+			parts := strings.SplitN(o, "=", 2)
+			if len(parts) != 2 || parts[0] != "port_handler" {
+				return nil, errors.Errorf("unknown port_handler option %q", o)
+			}
+			handler = parts[1]
+		}
+	}
+
+	switch handler {
+	case "rootlesskit", "":
+		if checkRLKFeatures().HasBuiltinDriver {
+			return &rlkPortForwarder{}, nil
+		}
+		return &socatPortForwarder{}, nil
+	case "socat":
+		return &socatPortForwarder{}, nil
+	default:
+		return nil, errors.Errorf("unknown port_handler for rootless networking: %q", handler)
+	}
+}
+
+// rlkPortForwarder forwards ports using the builtin RootlessKit-style port
+// driver (see pkg/rootlessport), running in a detached child process so
+// forwarding survives the calling podman process exiting.
+type rlkPortForwarder struct {
+	ctr    *Container
+	parent *rootlessport.Parent
+}
+
+// rootlessPortControlSocketPath returns the deterministic path rlkPortForwarder
+// places its control socket at, so a later podman invocation (e.g. one
+// calling AddPortMapping on an already-running detached container) can
+// reattach to it without needing the in-memory
+// RootlessPortForwarder that originally created it.
+func rootlessPortControlSocketPath(ctr *Container) string {
+	return filepath.Join(ctr.runtime.config.Engine.TmpDir, fmt.Sprintf("rootlessport-%s.sock", ctr.config.ID))
+}
+
+// slirpAPISocketPath returns the deterministic path setupSlirp4netns places
+// slirp4netns' `--api-socket` at for a container using slirp4netns for port
+// forwarding, so a later podman invocation can reattach to it the same way
+// rootlessPortControlSocketPath lets one reattach to the builtin driver.
+func slirpAPISocketPath(ctr *Container) string {
+	return filepath.Join(ctr.runtime.config.Engine.TmpDir, fmt.Sprintf("%s.net", ctr.config.ID))
+}
+
+// reattachRootlessPortForwarder returns the RootlessPortForwarder publishing
+// ctr's ports, finding one set up by an earlier invocation of podman if
+// necessary. AddPortMapping/RemovePortMapping usually run in a separate
+// podman invocation from the one that originally started the container,
+// so the in-memory forwarder
+// tracked by getRootlessPortForwarder is almost never set here; instead we
+// look for whichever forwarder's control channel left a well-known path
+// behind. socatPortForwarder has no such channel (each mapping is just a
+// socat process this code didn't start) and so cannot be reattached to.
+func reattachRootlessPortForwarder(ctr *Container) RootlessPortForwarder {
+	if forwarder := getRootlessPortForwarder(ctr); forwarder != nil {
+		return forwarder
+	}
+	if _, err := os.Stat(rootlessPortControlSocketPath(ctr)); err == nil {
+		return &rlkPortForwarder{ctr: ctr, parent: rootlessport.NewParent(rootlessPortControlSocketPath(ctr))}
+	}
+	if _, err := os.Stat(slirpAPISocketPath(ctr)); err == nil {
+		return newSlirpPortForwarder(nil, slirpAPISocketPath(ctr))
+	}
+	return nil
+}
+
+// slirpPortForwarder forwards ports through slirp4netns' own `add_hostfwd`/
+// `remove_hostfwd` API socket, avoiding the need for a separate port
+// forwarding process altogether.
+type slirpPortForwarder struct {
+	ctr       *Container
+	cmd       *exec.Cmd
+	apiSocket string
+}
+
+// socatPortForwarder is a fallback forwarder for environments where neither
+// the builtin RootlessKit driver nor slirp4netns' hostfwd API is usable. It
+// forwards each port mapping with its own `socat` process.
+type socatPortForwarder struct {
+	ctr  *Container
+	cmds map[string]*exec.Cmd
+}
+
+// slirp4netnsEnableIPv6 reports whether ctr was configured with the
+// `enable_ipv6=true` slirp4netns network option, so that callers outside of
+// setupSlirp4netns (namely the builtin RootlessKit port driver) can bind
+// their host-side wildcard listener to "::" instead of "0.0.0.0".
+func slirp4netnsEnableIPv6(ctr *Container) bool {
+	if ctr.config.NetworkOptions == nil {
+		return false
+	}
+	for _, o := range ctr.config.NetworkOptions["slirp4netns"] {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) == 2 && parts[0] == "enable_ipv6" && parts[1] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
 func checkSlirpFlags(path string) (*slirpFeatures, error) {
 	cmd := exec.Command(path, "--help")
 	out, err := cmd.CombinedOutput()
@@ -210,10 +388,27 @@ func (r *Runtime) setupRootlessNetNS(ctr *Container) error {
 		return r.setupSlirp4netns(ctr)
 	}
 	if len(ctr.config.Networks) > 0 {
-		// set up port forwarder for CNI-in-slirp4netns
+		// CNI-in-slirp4netns: actually run the CNI plugins for ctr's
+		// networks (in the shared rootless-cni infra namespace) before
+		// setting up the port forwarder, so rootless containers get
+		// real aliases, multi-network attach, and static IP/MAC
+		// support instead of just forwarded ports.
+		networkStatus, err := AllocRootlessCNI(context.Background(), ctr)
+		if err != nil {
+			return errors.Wrapf(err, "error configuring CNI-in-slirp4netns networking for container %s", ctr.ID())
+		}
+		ctr.state.NetworkStatus = networkStatus
+
 		netnsPath := ctr.state.NetNS.Path()
-		// TODO: support slirp4netns port forwarder as well
-		return r.setupRootlessPortMappingViaRLK(ctr, netnsPath)
+		forwarder, err := choosePortForwarder(ctr)
+		if err != nil {
+			return err
+		}
+		if err := forwarder.Setup(ctr, netnsPath); err != nil {
+			return err
+		}
+		setRootlessPortForwarder(ctr, forwarder)
+		return nil
 	}
 	return nil
 }
@@ -364,8 +559,11 @@ func (r *Runtime) setupSlirp4netns(ctr *Container) error {
 	}
 
 	var apiSocket string
-	if havePortMapping && isSlirpHostForward {
-		apiSocket = filepath.Join(ctr.runtime.config.Engine.TmpDir, fmt.Sprintf("%s.net", ctr.config.ID))
+	if isSlirpHostForward {
+		// Keep the api-socket around for the lifetime of the container, even
+		// if it isn't publishing any ports yet: AddPortMapping/RemovePortMapping
+		// need it to hot-(un)publish ports on a running container.
+		apiSocket = slirpAPISocketPath(ctr)
 		cmdArgs = append(cmdArgs, "--api-socket", apiSocket)
 	}
 
@@ -431,12 +629,21 @@ func (r *Runtime) setupSlirp4netns(ctr *Container) error {
 		return err
 	}
 
-	if havePortMapping {
+	if havePortMapping || isSlirpHostForward {
+		var forwarder RootlessPortForwarder
 		if isSlirpHostForward {
-			return r.setupRootlessPortMappingViaSlirp(ctr, cmd, apiSocket)
+			forwarder = newSlirpPortForwarder(cmd, apiSocket)
 		} else {
-			return r.setupRootlessPortMappingViaRLK(ctr, netnsPath)
+			var err error
+			forwarder, err = choosePortForwarder(ctr)
+			if err != nil {
+				return err
+			}
 		}
+		if err := forwarder.Setup(ctr, netnsPath); err != nil {
+			return err
+		}
+		setRootlessPortForwarder(ctr, forwarder)
 	}
 	return nil
 }
@@ -487,13 +694,17 @@ func waitForSync(syncR *os.File, cmd *exec.Cmd, logFile io.ReadSeeker, timeout t
 	return nil
 }
 
-func (r *Runtime) setupRootlessPortMappingViaRLK(ctr *Container, netnsPath string) error {
-	syncR, syncW, err := os.Pipe()
-	if err != nil {
-		return errors.Wrapf(err, "failed to open pipe")
-	}
-	defer errorhandling.CloseQuiet(syncR)
-	defer errorhandling.CloseQuiet(syncW)
+// Setup starts the builtin RootlessKit-style port driver in a detached
+// child process, re-exec'd from /proc/self/exe the same way the previous
+// exec-based rootlessport process was, so the forwarded ports keep working
+// after the calling podman process exits (the normal case for `podman run
+// -d`). The driver itself still does its forwarding in-process once
+// running, entering the container's network namespace (via
+// ns.WithNetNSPath) only for the lifetime of each accepted connection,
+// which keeps the throughput win over the old design; only the process
+// boundary needed for detachment was added back.
+func (f *rlkPortForwarder) Setup(ctr *Container, netnsPath string) error {
+	f.ctr = ctr
 
 	logPath := filepath.Join(ctr.runtime.config.Engine.TmpDir, fmt.Sprintf("rootlessport-%s.log", ctr.config.ID))
 	logFile, err := os.Create(logPath)
@@ -507,65 +718,53 @@ func (r *Runtime) setupRootlessPortMappingViaRLK(ctr *Container, netnsPath strin
 		return errors.Wrapf(err, "delete file %s", logPath)
 	}
 
-	if !ctr.config.PostConfigureNetNS {
-		ctr.rootlessPortSyncR, ctr.rootlessPortSyncW, err = os.Pipe()
-		if err != nil {
-			return errors.Wrapf(err, "failed to create rootless port sync pipe")
-		}
-	}
-
-	cfg := rootlessport.Config{
-		Mappings:  ctr.config.PortMappings,
-		NetNSPath: netnsPath,
-		ExitFD:    3,
-		ReadyFD:   4,
-		TmpDir:    ctr.runtime.config.Engine.TmpDir,
-	}
-	cfgJSON, err := json.Marshal(cfg)
+	parent, err := rootlessport.StartParent(rootlessport.Config{
+		Mappings:      ctr.config.PortMappings,
+		NetNSPath:     netnsPath,
+		EnableIPv6:    slirp4netnsEnableIPv6(ctr),
+		TmpDir:        ctr.runtime.config.Engine.TmpDir,
+		ControlSocket: rootlessPortControlSocketPath(ctr),
+	}, logFile)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "failed to start rootlessport child process")
 	}
-	cfgR := bytes.NewReader(cfgJSON)
-	var stdout bytes.Buffer
-	cmd := exec.Command(fmt.Sprintf("/proc/%d/exe", os.Getpid()))
-	cmd.Args = []string{rootlessport.ReexecKey}
-	// Leak one end of the pipe in rootlessport process, the other will be sent to conmon
 
-	if ctr.rootlessPortSyncR != nil {
-		defer errorhandling.CloseQuiet(ctr.rootlessPortSyncR)
-	}
+	f.parent = parent
+	logrus.Debug("rootlessport is ready")
+	return nil
+}
 
-	cmd.ExtraFiles = append(cmd.ExtraFiles, ctr.rootlessPortSyncR, syncW)
-	cmd.Stdin = cfgR
-	// stdout is for human-readable error, stderr is for debug log
-	cmd.Stdout = &stdout
-	cmd.Stderr = io.MultiWriter(logFile, &logrusDebugWriter{"rootlessport: "})
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid: true,
+// Teardown asks the detached rootlessport child to stop forwarding and
+// exit.
+func (f *rlkPortForwarder) Teardown() error {
+	if f.parent == nil {
+		return nil
 	}
-	if err := cmd.Start(); err != nil {
-		return errors.Wrapf(err, "failed to start rootlessport process")
+	return f.parent.Close()
+}
+
+func (f *rlkPortForwarder) AddMapping(pm ocicni.PortMapping) error {
+	if f.parent == nil {
+		return errors.Errorf("rootlessport child process is not running")
 	}
-	defer func() {
-		if err := cmd.Process.Release(); err != nil {
-			logrus.Errorf("unable to release rootlessport process: %q", err)
-		}
-	}()
-	if err := waitForSync(syncR, cmd, logFile, 3*time.Second); err != nil {
-		stdoutStr := stdout.String()
-		if stdoutStr != "" {
-			// err contains full debug log and too verbose, so return stdoutStr
-			logrus.Debug(err)
-			return errors.Errorf("rootlessport " + strings.TrimSuffix(stdoutStr, "\n"))
-		}
-		return err
+	return f.parent.AddPort(pm)
+}
+
+func (f *rlkPortForwarder) RemoveMapping(pm ocicni.PortMapping) error {
+	if f.parent == nil {
+		return errors.Errorf("rootlessport child process is not running")
 	}
-	logrus.Debug("rootlessport is ready")
-	return nil
+	return f.parent.RemovePort(pm)
+}
+
+func newSlirpPortForwarder(cmd *exec.Cmd, apiSocket string) *slirpPortForwarder {
+	return &slirpPortForwarder{cmd: cmd, apiSocket: apiSocket}
 }
 
-func (r *Runtime) setupRootlessPortMappingViaSlirp(ctr *Container, cmd *exec.Cmd, apiSocket string) (err error) {
+func (f *slirpPortForwarder) Setup(ctr *Container, netnsPath string) (err error) {
+	f.ctr = ctr
 	const pidWaitTimeout = 60 * time.Second
+	cmd := f.cmd
 	chWait := make(chan error)
 	go func() {
 		interval := 25 * time.Millisecond
@@ -588,63 +787,151 @@ func (r *Runtime) setupRootlessPortMappingViaSlirp(ctr *Container, cmd *exec.Cmd
 	defer close(chWait)
 
 	// wait that API socket file appears before trying to use it.
-	if _, err := WaitForFile(apiSocket, chWait, pidWaitTimeout); err != nil {
-		return errors.Wrapf(err, "waiting for slirp4nets to create the api socket file %s", apiSocket)
+	if _, err := WaitForFile(f.apiSocket, chWait, pidWaitTimeout); err != nil {
+		return errors.Wrapf(err, "waiting for slirp4nets to create the api socket file %s", f.apiSocket)
 	}
 
 	// for each port we want to add we need to open a connection to the slirp4netns control socket
 	// and send the add_hostfwd command.
 	for _, i := range ctr.config.PortMappings {
-		conn, err := net.Dial("unix", apiSocket)
-		if err != nil {
-			return errors.Wrapf(err, "cannot open connection to %s", apiSocket)
-		}
-		defer func() {
-			if err := conn.Close(); err != nil {
-				logrus.Errorf("unable to close connection: %q", err)
-			}
-		}()
-		hostIP := i.HostIP
-		if hostIP == "" {
-			hostIP = "0.0.0.0"
-		}
-		apiCmd := slirp4netnsCmd{
-			Execute: "add_hostfwd",
-			Args: slirp4netnsCmdArg{
-				Proto:     i.Protocol,
-				HostAddr:  hostIP,
-				HostPort:  i.HostPort,
-				GuestPort: i.ContainerPort,
-			},
-		}
-		// create the JSON payload and send it.  Mark the end of request shutting down writes
-		// to the socket, as requested by slirp4netns.
-		data, err := json.Marshal(&apiCmd)
-		if err != nil {
-			return errors.Wrapf(err, "cannot marshal JSON for slirp4netns")
-		}
-		if _, err := conn.Write([]byte(fmt.Sprintf("%s\n", data))); err != nil {
-			return errors.Wrapf(err, "cannot write to control socket %s", apiSocket)
-		}
-		if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
-			return errors.Wrapf(err, "cannot shutdown the socket %s", apiSocket)
+		if err := f.AddMapping(i); err != nil {
+			return err
 		}
-		buf := make([]byte, 2048)
-		readLength, err := conn.Read(buf)
-		if err != nil {
-			return errors.Wrapf(err, "cannot read from control socket %s", apiSocket)
+	}
+	logrus.Debug("slirp4netns port-forwarding setup via add_hostfwd is ready")
+	return nil
+}
+
+// Teardown is a no-op: the slirp4netns process itself is started and managed
+// by setupSlirp4netns, and its API socket is torn down along with it.
+func (f *slirpPortForwarder) Teardown() error {
+	return nil
+}
+
+func (f *slirpPortForwarder) AddMapping(pm ocicni.PortMapping) error {
+	return f.sendHostFwd("add_hostfwd", pm)
+}
+
+func (f *slirpPortForwarder) RemoveMapping(pm ocicni.PortMapping) error {
+	return f.sendHostFwd("remove_hostfwd", pm)
+}
+
+// sendHostFwd opens a connection to the slirp4netns control socket and sends
+// execute (either "add_hostfwd" or "remove_hostfwd") for the given mapping.
+func (f *slirpPortForwarder) sendHostFwd(execute string, pm ocicni.PortMapping) error {
+	conn, err := net.Dial("unix", f.apiSocket)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open connection to %s", f.apiSocket)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logrus.Errorf("unable to close connection: %q", err)
 		}
-		// if there is no 'error' key in the received JSON data, then the operation was
-		// successful.
-		var y map[string]interface{}
-		if err := json.Unmarshal(buf[0:readLength], &y); err != nil {
-			return errors.Wrapf(err, "error parsing error status from slirp4netns")
+	}()
+	hostIP := pm.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	apiCmd := slirp4netnsCmd{
+		Execute: execute,
+		Args: slirp4netnsCmdArg{
+			Proto:     pm.Protocol,
+			HostAddr:  hostIP,
+			HostPort:  pm.HostPort,
+			GuestPort: pm.ContainerPort,
+		},
+	}
+	// create the JSON payload and send it.  Mark the end of request shutting down writes
+	// to the socket, as requested by slirp4netns.
+	data, err := json.Marshal(&apiCmd)
+	if err != nil {
+		return errors.Wrapf(err, "cannot marshal JSON for slirp4netns")
+	}
+	if _, err := conn.Write([]byte(fmt.Sprintf("%s\n", data))); err != nil {
+		return errors.Wrapf(err, "cannot write to control socket %s", f.apiSocket)
+	}
+	if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
+		return errors.Wrapf(err, "cannot shutdown the socket %s", f.apiSocket)
+	}
+	buf := make([]byte, 2048)
+	readLength, err := conn.Read(buf)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read from control socket %s", f.apiSocket)
+	}
+	// if there is no 'error' key in the received JSON data, then the operation was
+	// successful.
+	var y map[string]interface{}
+	if err := json.Unmarshal(buf[0:readLength], &y); err != nil {
+		return errors.Wrapf(err, "error parsing error status from slirp4netns")
+	}
+	if e, found := y["error"]; found {
+		return errors.Errorf("error from slirp4netns while setting up port redirection: %v", e)
+	}
+	return nil
+}
+
+// portMappingKey returns a unique key identifying a port mapping, used to
+// track the socat process forwarding it.
+func portMappingKey(pm ocicni.PortMapping) string {
+	return fmt.Sprintf("%s:%s:%d:%d", pm.Protocol, pm.HostIP, pm.HostPort, pm.ContainerPort)
+}
+
+// Setup starts one socat process per configured port mapping. socat is used
+// as a last-resort fallback in environments where neither the builtin
+// RootlessKit driver nor slirp4netns' hostfwd API is usable.
+func (f *socatPortForwarder) Setup(ctr *Container, netnsPath string) error {
+	f.ctr = ctr
+	f.cmds = make(map[string]*exec.Cmd, len(ctr.config.PortMappings))
+	for _, pm := range ctr.config.PortMappings {
+		if err := f.AddMapping(pm); err != nil {
+			return err
 		}
-		if e, found := y["error"]; found {
-			return errors.Errorf("error from slirp4netns while setting up port redirection: %v", e)
+	}
+	return nil
+}
+
+func (f *socatPortForwarder) Teardown() error {
+	var lastErr error
+	for key, cmd := range f.cmds {
+		if err := cmd.Process.Kill(); err != nil {
+			lastErr = errors.Wrapf(err, "unable to kill socat process for mapping %s", key)
+			logrus.Errorf("%v", lastErr)
 		}
+		delete(f.cmds, key)
 	}
-	logrus.Debug("slirp4netns port-forwarding setup via add_hostfwd is ready")
+	return lastErr
+}
+
+func (f *socatPortForwarder) AddMapping(pm ocicni.PortMapping) error {
+	hostIP := pm.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	proto := strings.ToUpper(pm.Protocol)
+	if proto == "" {
+		proto = "TCP"
+	}
+	listenAddr := fmt.Sprintf("%s-LISTEN:%d,bind=%s,fork,reuseaddr", proto, pm.HostPort, hostIP)
+	connectAddr := fmt.Sprintf("%s:127.0.0.1:%d", proto, pm.ContainerPort)
+	cmd := exec.Command("socat", listenAddr, connectAddr)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start socat for port mapping %d->%d", pm.HostPort, pm.ContainerPort)
+	}
+	f.cmds[portMappingKey(pm)] = cmd
+	return nil
+}
+
+func (f *socatPortForwarder) RemoveMapping(pm ocicni.PortMapping) error {
+	key := portMappingKey(pm)
+	cmd, ok := f.cmds[key]
+	if !ok {
+		return errors.Errorf("no socat forwarder found for mapping %d->%d", pm.HostPort, pm.ContainerPort)
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		return errors.Wrapf(err, "failed to stop socat for port mapping %d->%d", pm.HostPort, pm.ContainerPort)
+	}
+	delete(f.cmds, key)
 	return nil
 }
 
@@ -725,30 +1012,24 @@ func (r *Runtime) teardownNetNS(ctr *Container) error {
 
 	logrus.Debugf("Tearing down network namespace at %s for container %s", ctr.state.NetNS.Path(), ctr.ID())
 
-	// rootless containers do not use the CNI plugin directly
-	if !rootless.IsRootless() && !ctr.config.NetMode.IsSlirp4netns() {
-		var requestedIP net.IP
-		if ctr.requestedIP != nil {
-			requestedIP = ctr.requestedIP
-			// cancel request for a specific IP in case the container is reused later
-			ctr.requestedIP = nil
-		} else {
-			requestedIP = ctr.config.StaticIP
+	// Stop forwarding rootless ports before tearing down anything else, so
+	// we don't leak the host-side listeners/child process of whichever
+	// RootlessPortForwarder was set up for this container.
+	if forwarder := getRootlessPortForwarder(ctr); forwarder != nil {
+		if err := forwarder.Teardown(); err != nil {
+			return errors.Wrapf(err, "error tearing down port forwarding for container %s", ctr.ID())
 		}
+		clearRootlessPortForwarder(ctr)
+	}
 
-		var requestedMAC net.HardwareAddr
-		if ctr.requestedMAC != nil {
-			requestedMAC = ctr.requestedMAC
-			// cancel request for a specific MAC in case the container is reused later
-			ctr.requestedMAC = nil
-		} else {
-			requestedMAC = ctr.config.StaticMAC
+	// rootless containers do not use the network backend directly
+	if !rootless.IsRootless() && !ctr.config.NetMode.IsSlirp4netns() {
+		backend, err := r.getNetworkBackend(ctr)
+		if err != nil {
+			return err
 		}
-
-		podNetwork := r.getPodNetwork(ctr.ID(), ctr.Name(), ctr.state.NetNS.Path(), ctr.config.Networks, ctr.config.PortMappings, requestedIP, requestedMAC)
-
-		if err := r.netPlugin.TearDownPod(podNetwork); err != nil {
-			return errors.Wrapf(err, "error tearing down CNI namespace configuration for container %s", ctr.ID())
+		if err := backend.Teardown(ctr, ctr.state.NetNS.Path()); err != nil {
+			return errors.Wrapf(err, "error tearing down network namespace configuration for container %s", ctr.ID())
 		}
 	}
 
@@ -774,6 +1055,60 @@ func (r *Runtime) teardownNetNS(ctr *Container) error {
 	return nil
 }
 
+// AddPortMapping starts forwarding an additional port to a running rootless
+// container and persists it in the container's config so that restarting the
+// container reproduces the new set of published ports.
+func (c *Container) AddPortMapping(pm ocicni.PortMapping) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.syncContainer(); err != nil {
+		return err
+	}
+
+	forwarder := reattachRootlessPortForwarder(c)
+	if forwarder == nil {
+		return errors.Errorf("container %s does not have a rootless port forwarder configured", c.ID())
+	}
+
+	if err := forwarder.AddMapping(pm); err != nil {
+		return errors.Wrapf(err, "error adding port mapping to container %s", c.ID())
+	}
+
+	c.config.PortMappings = append(c.config.PortMappings, pm)
+
+	return c.save()
+}
+
+// RemovePortMapping stops forwarding a previously-published port on a running
+// rootless container and removes it from the container's persisted config.
+func (c *Container) RemovePortMapping(pm ocicni.PortMapping) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.syncContainer(); err != nil {
+		return err
+	}
+
+	forwarder := reattachRootlessPortForwarder(c)
+	if forwarder == nil {
+		return errors.Errorf("container %s does not have a rootless port forwarder configured", c.ID())
+	}
+
+	if err := forwarder.RemoveMapping(pm); err != nil {
+		return errors.Wrapf(err, "error removing port mapping from container %s", c.ID())
+	}
+
+	for i, existing := range c.config.PortMappings {
+		if portMappingKey(existing) == portMappingKey(pm) {
+			c.config.PortMappings = append(c.config.PortMappings[:i], c.config.PortMappings[i+1:]...)
+			break
+		}
+	}
+
+	return c.save()
+}
+
 func getContainerNetNS(ctr *Container) (string, error) {
 	if ctr.state.NetNS != nil {
 		return ctr.state.NetNS.Path(), nil
@@ -791,13 +1126,26 @@ func getContainerNetNS(ctr *Container) (string, error) {
 	return "", nil
 }
 
-func getContainerNetIO(ctr *Container) (*netlink.LinkStatistics, error) {
-	var netStats *netlink.LinkStatistics
+// ContainerNetworkStats holds per-interface network statistics for a single
+// container, keyed by interface name (e.g. "eth0", "net1"), plus an
+// Aggregate of every interface's counters combined. The per-interface map
+// lets containers joined to more than one network, or with additional
+// interfaces (macvlan, ipvlan, extra bridges), report counters for all of
+// them instead of only the default interface.
+type ContainerNetworkStats struct {
+	Interfaces map[string]*netlink.LinkStatistics
+	Aggregate  netlink.LinkStatistics
+}
+
+// getContainerNetIO enumerates every non-loopback interface inside ctr's
+// network namespace and returns their statistics.
+func getContainerNetIO(ctr *Container) (*ContainerNetworkStats, error) {
+	stats := &ContainerNetworkStats{Interfaces: make(map[string]*netlink.LinkStatistics)}
 	// rootless v2 cannot seem to resolve its network connection to
 	// collect statistics.  For now, we allow stats to at least run
 	// by returning nil
 	if rootless.IsRootless() {
-		return netStats, nil
+		return stats, nil
 	}
 	netNSPath, netPathErr := getContainerNetNS(ctr)
 	if netPathErr != nil {
@@ -806,17 +1154,31 @@ func getContainerNetIO(ctr *Container) (*netlink.LinkStatistics, error) {
 	if netNSPath == "" {
 		// If netNSPath is empty, it was set as none, and no netNS was set up
 		// this is a valid state and thus return no error, nor any statistics
-		return nil, nil
+		return stats, nil
 	}
 	err := ns.WithNetNSPath(netNSPath, func(_ ns.NetNS) error {
-		link, err := netlink.LinkByName(ocicni.DefaultInterfaceName)
+		links, err := netlink.LinkList()
 		if err != nil {
 			return err
 		}
-		netStats = link.Attrs().Statistics
+		for _, link := range links {
+			attrs := link.Attrs()
+			if attrs.Flags&net.FlagLoopback != 0 || attrs.Statistics == nil {
+				continue
+			}
+			stats.Interfaces[attrs.Name] = attrs.Statistics
+			stats.Aggregate.RxBytes += attrs.Statistics.RxBytes
+			stats.Aggregate.RxPackets += attrs.Statistics.RxPackets
+			stats.Aggregate.RxErrors += attrs.Statistics.RxErrors
+			stats.Aggregate.RxDropped += attrs.Statistics.RxDropped
+			stats.Aggregate.TxBytes += attrs.Statistics.TxBytes
+			stats.Aggregate.TxPackets += attrs.Statistics.TxPackets
+			stats.Aggregate.TxErrors += attrs.Statistics.TxErrors
+			stats.Aggregate.TxDropped += attrs.Statistics.TxDropped
+		}
 		return nil
 	})
-	return netStats, err
+	return stats, err
 }
 
 // Produce an InspectNetworkSettings containing information on the container
@@ -907,8 +1269,21 @@ func (c *Container) getContainerNetworkInfo() (*define.InspectNetworkSettings, e
 	return settings, nil
 }
 
+// macForIP returns the MAC address of the interface ctrIP was assigned to,
+// if result says which interface that was.
+func macForIP(ctrIP *cnitypes.IPConfig, result *cnitypes.Result) string {
+	if ctrIP.Interface != nil && *ctrIP.Interface >= 0 && *ctrIP.Interface < len(result.Interfaces) {
+		return result.Interfaces[*ctrIP.Interface].Mac
+	}
+	return ""
+}
+
 // resultToBasicNetworkConfig produces an InspectBasicNetworkConfig from a CNI
-// result
+// result. The first IPv4 and first IPv6 address seen become the primary
+// IPAddress/GlobalIPv6Address (with their own gateway); everything else is
+// recorded as a secondary address. MacAddress is the MAC of the interface
+// the first address naming one was assigned to; the MAC of any other
+// interface an address was assigned to is recorded in AdditionalMacAddresses.
 func resultToBasicNetworkConfig(result *cnitypes.Result) (define.InspectBasicNetworkConfig, error) {
 	config := define.InspectBasicNetworkConfig{}
 
@@ -919,20 +1294,30 @@ func resultToBasicNetworkConfig(result *cnitypes.Result) (define.InspectBasicNet
 			config.IPAddress = ctrIP.Address.IP.String()
 			config.IPPrefixLen = size
 			config.Gateway = ctrIP.Gateway.String()
-			if ctrIP.Interface != nil && *ctrIP.Interface < len(result.Interfaces) && *ctrIP.Interface > 0 {
-				config.MacAddress = result.Interfaces[*ctrIP.Interface].Mac
+			if mac := macForIP(ctrIP, result); mac != "" && config.MacAddress == "" {
+				config.MacAddress = mac
+			} else if mac != "" && mac != config.MacAddress {
+				config.AdditionalMacAddresses = append(config.AdditionalMacAddresses, mac)
 			}
 		case ctrIP.Version == "4" && config.IPAddress != "":
 			config.SecondaryIPAddresses = append(config.SecondaryIPAddresses, ctrIP.Address.String())
-			if ctrIP.Interface != nil && *ctrIP.Interface < len(result.Interfaces) && *ctrIP.Interface > 0 {
-				config.AdditionalMacAddresses = append(config.AdditionalMacAddresses, result.Interfaces[*ctrIP.Interface].Mac)
+			if mac := macForIP(ctrIP, result); mac != "" && mac != config.MacAddress {
+				config.AdditionalMacAddresses = append(config.AdditionalMacAddresses, mac)
 			}
-		case ctrIP.Version == "6" && config.IPAddress == "":
+		case ctrIP.Version == "6" && config.GlobalIPv6Address == "":
 			config.GlobalIPv6Address = ctrIP.Address.IP.String()
 			config.GlobalIPv6PrefixLen = size
 			config.IPv6Gateway = ctrIP.Gateway.String()
-		case ctrIP.Version == "6" && config.IPAddress != "":
+			if mac := macForIP(ctrIP, result); mac != "" && config.MacAddress == "" {
+				config.MacAddress = mac
+			} else if mac != "" && mac != config.MacAddress {
+				config.AdditionalMacAddresses = append(config.AdditionalMacAddresses, mac)
+			}
+		case ctrIP.Version == "6" && config.GlobalIPv6Address != "":
 			config.SecondaryIPv6Addresses = append(config.SecondaryIPv6Addresses, ctrIP.Address.String())
+			if mac := macForIP(ctrIP, result); mac != "" && mac != config.MacAddress {
+				config.AdditionalMacAddresses = append(config.AdditionalMacAddresses, mac)
+			}
 		default:
 			return config, errors.Wrapf(define.ErrInternal, "unrecognized IP version %q", ctrIP.Version)
 		}
@@ -947,12 +1332,3 @@ func resultToBasicNetworkConfig(result *cnitypes.Result) (define.InspectBasicNet
 func getCNINetworksDir() (string, error) {
 	return "/var/lib/cni/networks", nil
 }
-
-type logrusDebugWriter struct {
-	prefix string
-}
-
-func (w *logrusDebugWriter) Write(p []byte) (int, error) {
-	logrus.Debugf("%s%s", w.prefix, string(p))
-	return len(p), nil
-}
@@ -0,0 +1,329 @@
+// +build linux
+
+package libpod
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containers/podman/v2/pkg/netns"
+	"github.com/cri-o/ocicni/pkg/ocicni"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// rootlessCNI is the lazily-created, refcounted "infra" network namespace
+// that CNI-in-slirp4netns runs its plugins in. Rootless users can't run CNI
+// plugins (the bridge driver, macvlan, host-local IPAM, the dnsname
+// aliasing plugin...) directly in a container's own namespace, since those
+// plugins create host-visible interfaces and expect a routable namespace to
+// do it from. Instead every rootless CNI network a user has is set up once
+// in this shared namespace, which is itself bridged to the outside world
+// over slirp4netns, and each container's own veth end is then moved out of
+// it into the container's namespace.
+type rootlessCNI struct {
+	lock sync.Mutex
+	ns   ns.NetNS
+	dir  string
+	cmd  *exec.Cmd
+	// refCount is the number of containers currently relying on this
+	// namespace. The namespace (and its slirp4netns bridge) are torn
+	// down once the last one leaves.
+	refCount int
+}
+
+// rootlessCNIRegistry tracks each Runtime's shared rootless-CNI infra
+// namespace. It lives here instead of as a field on Runtime itself, keyed by
+// the Runtime pointer and guarded by its own lock, since a process only ever
+// has one or two live Runtimes and this state is never persisted to disk.
+var (
+	rootlessCNIRegistryLock sync.Mutex
+	rootlessCNIRegistry     = make(map[*Runtime]*rootlessCNI)
+)
+
+// getRootlessCNI returns the Runtime's shared rootless-CNI infra namespace,
+// lazily creating it (and bridging it to the host with slirp4netns) the
+// first time a rootless container needs to join a CNI network.
+func (r *Runtime) getRootlessCNI() (*rootlessCNI, error) {
+	rootlessCNIRegistryLock.Lock()
+	defer rootlessCNIRegistryLock.Unlock()
+
+	if rc, ok := rootlessCNIRegistry[r]; ok {
+		return rc, nil
+	}
+
+	infraNS, err := netns.NewNS()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating rootless-cni infra network namespace")
+	}
+
+	dir := filepath.Join(r.config.Engine.TmpDir, "rootless-cni")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		cleanupRootlessCNINS(infraNS)
+		return nil, errors.Wrapf(err, "error creating rootless-cni state dir %s", dir)
+	}
+
+	rc := &rootlessCNI{ns: infraNS, dir: dir}
+	if err := rc.startSlirp4netns(r); err != nil {
+		cleanupRootlessCNINS(infraNS)
+		return nil, err
+	}
+
+	rootlessCNIRegistry[r] = rc
+	return rc, nil
+}
+
+func cleanupRootlessCNINS(infraNS ns.NetNS) {
+	if err := netns.UnmountNS(infraNS); err != nil {
+		logrus.Errorf("error unmounting partially created rootless-cni namespace: %v", err)
+	}
+	if err := infraNS.Close(); err != nil {
+		logrus.Errorf("error closing partially created rootless-cni namespace: %v", err)
+	}
+}
+
+// startSlirp4netns bridges the infra namespace to the host network, the
+// same way setupSlirp4netns bridges an individual container's namespace, so
+// that the CNI networks set up inside it (and the containers attached to
+// them) can still reach the outside world.
+func (rc *rootlessCNI) startSlirp4netns(r *Runtime) error {
+	path := r.config.Engine.NetworkCmdPath
+	if path == "" {
+		var err error
+		path, err = exec.LookPath("slirp4netns")
+		if err != nil {
+			return errors.Wrapf(err, "could not find slirp4netns, rootless CNI networking is unavailable")
+		}
+	}
+
+	features, err := checkSlirpFlags(path)
+	if err != nil {
+		return errors.Wrapf(err, "error checking slirp4netns binary %s", path)
+	}
+
+	cmdArgs := []string{}
+	if features.HasDisableHostLoopback {
+		cmdArgs = append(cmdArgs, "--disable-host-loopback")
+	}
+	if features.HasMTU {
+		cmdArgs = append(cmdArgs, "--mtu", "65520")
+	}
+	if features.HasEnableSandbox {
+		cmdArgs = append(cmdArgs, "--enable-sandbox")
+	}
+	if features.HasEnableSeccomp {
+		cmdArgs = append(cmdArgs, "--enable-seccomp")
+	}
+	cmdArgs = append(cmdArgs, "-c", "--netns-type=path", rc.ns.Path(), "tap0")
+
+	cmd := exec.Command(path, cmdArgs...)
+	logrus.Debugf("rootless-cni slirp4netns command: %s", strings.Join(cmd.Args, " "))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	logPath := filepath.Join(rc.dir, "slirp4netns.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open rootless-cni slirp4netns log file %s", logPath)
+	}
+	defer logFile.Close()
+	if err := os.Remove(logPath); err != nil {
+		return errors.Wrapf(err, "delete file %s", logPath)
+	}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start rootless-cni slirp4netns")
+	}
+	if err := cmd.Process.Release(); err != nil {
+		logrus.Errorf("unable to release rootless-cni slirp4netns process: %v", err)
+	}
+	rc.cmd = cmd
+	return nil
+}
+
+// AllocRootlessCNI sets up ctr's CNI networks for a rootless container.
+// Because CNI plugins can't be run inside a rootless container's own
+// namespace, CNI ADD is run once against the Runtime's shared rootless-CNI
+// infra namespace instead, and the resulting veth end for each network is
+// then moved into ctr's own namespace (with its IP/route configuration
+// re-applied there, since moving a link across namespaces drops it). This
+// gives rootless containers the same DNS-based aliases, multi-network
+// attach, and static IP/MAC support as rootful CNI networking.
+func AllocRootlessCNI(ctx context.Context, ctr *Container) ([]*cnitypes.Result, error) {
+	r := ctr.runtime
+
+	rc, err := r.getRootlessCNI()
+	if err != nil {
+		return nil, err
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	// discardIfUnused undoes getRootlessCNI's work if rc isn't being shared
+	// by any other container yet (refCount == 0): without this, a failure
+	// setting up the very first container to use rootless CNI would leave a
+	// broken infra namespace cached under r forever, since nothing else ever
+	// calls DeallocRootlessCNI for a container whose Alloc never succeeded.
+	discardIfUnused := func() {
+		if rc.refCount != 0 {
+			return
+		}
+		if err := destroyRootlessCNI(r, rc); err != nil {
+			logrus.Errorf("Error tearing down rootless-cni infra namespace after failed setup: %v", err)
+		}
+	}
+
+	backend := &cniNetworkBackend{runtime: r}
+	results, err := backend.Setup(ctr, rc.ns.Path())
+	if err != nil {
+		discardIfUnused()
+		return nil, err
+	}
+
+	if err := moveResultsToContainerNS(rc.ns, ctr.state.NetNS, results); err != nil {
+		if tErr := backend.Teardown(ctr, ctr.state.NetNS.Path()); tErr != nil {
+			logrus.Errorf("Error tearing down partially created rootless-cni networking for container %s: %v", ctr.ID(), tErr)
+		}
+		discardIfUnused()
+		return nil, err
+	}
+
+	rc.refCount++
+
+	networkStatus := make([]*cnitypes.Result, 0, len(results))
+	for _, res := range results {
+		networkStatus = append(networkStatus, res.Result)
+	}
+	return networkStatus, nil
+}
+
+// DeallocRootlessCNI tears down ctr's rootless-CNI networking, undoing
+// AllocRootlessCNI. CNI DEL is run against ctr's own namespace, since that
+// is where AllocRootlessCNI moved the network interfaces to; removing a
+// veth end there also removes its paired end still attached to a bridge in
+// the infra namespace. Once the last container using the infra namespace
+// has left, the namespace and its slirp4netns bridge are torn down too.
+func DeallocRootlessCNI(ctx context.Context, ctr *Container) error {
+	r := ctr.runtime
+
+	rootlessCNIRegistryLock.Lock()
+	rc := rootlessCNIRegistry[r]
+	rootlessCNIRegistryLock.Unlock()
+	if rc == nil || ctr.state.NetNS == nil {
+		return nil
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	backend := &cniNetworkBackend{runtime: r}
+	if err := backend.Teardown(ctr, ctr.state.NetNS.Path()); err != nil {
+		return errors.Wrapf(err, "error tearing down rootless-cni networking for container %s", ctr.ID())
+	}
+
+	rc.refCount--
+	if rc.refCount > 0 {
+		return nil
+	}
+
+	return destroyRootlessCNI(r, rc)
+}
+
+// destroyRootlessCNI kills rc's slirp4netns process and unmounts and closes
+// its infra namespace, then forgets it in r's registry. Callers must hold
+// rc.lock.
+func destroyRootlessCNI(r *Runtime, rc *rootlessCNI) error {
+	rootlessCNIRegistryLock.Lock()
+	delete(rootlessCNIRegistry, r)
+	rootlessCNIRegistryLock.Unlock()
+
+	if rc.cmd != nil && rc.cmd.Process != nil {
+		if err := rc.cmd.Process.Kill(); err != nil {
+			logrus.Errorf("error killing rootless-cni slirp4netns process: %v", err)
+		}
+	}
+	if err := netns.UnmountNS(rc.ns); err != nil {
+		return errors.Wrapf(err, "error unmounting rootless-cni infra namespace")
+	}
+	return rc.ns.Close()
+}
+
+// moveResultsToContainerNS moves the interface CNI created for each network
+// result out of infraNS and into containerNS, re-applying the addresses and
+// routes CNI assigned it.
+func moveResultsToContainerNS(infraNS, containerNS ns.NetNS, results []*NetworkResult) error {
+	return ns.WithNetNSPath(infraNS.Path(), func(_ ns.NetNS) error {
+		for _, res := range results {
+			ifName := interfaceNameFor(res.Result)
+			if err := moveInterfaceToNetNS(ifName, containerNS, res.Result); err != nil {
+				return errors.Wrapf(err, "error moving interface %s for network %s into the container namespace", ifName, res.NetworkName)
+			}
+		}
+		return nil
+	})
+}
+
+// interfaceNameFor returns the name CNI gave the container-side interface in
+// result, falling back to ocicni's default if the result doesn't say.
+func interfaceNameFor(result *cnitypes.Result) string {
+	for _, ip := range result.IPs {
+		if ip.Interface != nil && *ip.Interface >= 0 && *ip.Interface < len(result.Interfaces) {
+			if name := result.Interfaces[*ip.Interface].Name; name != "" {
+				return name
+			}
+		}
+	}
+	return ocicni.DefaultInterfaceName
+}
+
+// moveInterfaceToNetNS must be called from inside the namespace ifName
+// currently lives in. It moves the link into containerNS and, since moving
+// a link across namespaces drops its L3 configuration, re-applies the
+// addresses and routes from result there.
+func moveInterfaceToNetNS(ifName string, containerNS ns.NetNS, result *cnitypes.Result) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find interface %s in the rootless-cni namespace", ifName)
+	}
+
+	if err := netlink.LinkSetDown(link); err != nil {
+		return errors.Wrapf(err, "failed to set %s down before moving it", ifName)
+	}
+
+	if err := netlink.LinkSetNsFd(link, int(containerNS.Fd())); err != nil {
+		return errors.Wrapf(err, "failed to move %s into the container namespace", ifName)
+	}
+
+	return containerNS.Do(func(_ ns.NetNS) error {
+		movedLink, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return errors.Wrapf(err, "failed to find %s after moving it into the container namespace", ifName)
+		}
+		for _, ip := range result.IPs {
+			addr := &netlink.Addr{IPNet: &ip.Address}
+			if err := netlink.AddrAdd(movedLink, addr); err != nil {
+				return errors.Wrapf(err, "failed to re-add address %s to %s", addr, ifName)
+			}
+		}
+		if err := netlink.LinkSetUp(movedLink); err != nil {
+			return errors.Wrapf(err, "failed to bring %s back up", ifName)
+		}
+		for _, route := range result.Routes {
+			r := &netlink.Route{LinkIndex: movedLink.Attrs().Index, Dst: &route.Dst, Gw: route.GW}
+			if err := netlink.RouteAdd(r); err != nil && !os.IsExist(err) {
+				return errors.Wrapf(err, "failed to re-add route %s to %s", route.Dst.String(), ifName)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+// +build linux
+
+package libpod
+
+import (
+	"net"
+	"sync"
+)
+
+// rootlessNetworkState holds per-container, in-process bookkeeping for
+// rootless networking that is not part of the persisted container config:
+// the live RootlessPortForwarder set up for a running container, and a
+// one-shot requested IPv6 address mirroring the existing handling of a
+// requested IPv4 address or MAC. None of this needs to survive a process
+// restart, so it is kept in a package-level table keyed by container ID
+// instead of on Container itself, guarded by its own lock independent of
+// the container's lock.
+type rootlessNetworkState struct {
+	portForwarder RootlessPortForwarder
+	requestedIP6  net.IP
+}
+
+var (
+	rootlessNetworkStateLock sync.Mutex
+	rootlessNetworkStates    = make(map[string]*rootlessNetworkState)
+)
+
+// getRootlessPortForwarder returns the RootlessPortForwarder currently
+// forwarding ctr's ports, or nil if none is set up in this process.
+func getRootlessPortForwarder(ctr *Container) RootlessPortForwarder {
+	rootlessNetworkStateLock.Lock()
+	defer rootlessNetworkStateLock.Unlock()
+	if st, ok := rootlessNetworkStates[ctr.ID()]; ok {
+		return st.portForwarder
+	}
+	return nil
+}
+
+// setRootlessPortForwarder records the RootlessPortForwarder forwarding
+// ctr's ports.
+func setRootlessPortForwarder(ctr *Container, f RootlessPortForwarder) {
+	rootlessNetworkStateLock.Lock()
+	defer rootlessNetworkStateLock.Unlock()
+	st, ok := rootlessNetworkStates[ctr.ID()]
+	if !ok {
+		st = &rootlessNetworkState{}
+		rootlessNetworkStates[ctr.ID()] = st
+	}
+	st.portForwarder = f
+}
+
+// clearRootlessPortForwarder forgets ctr's port forwarder, freeing the
+// tracking entry entirely once there is no other state left to keep for it.
+func clearRootlessPortForwarder(ctr *Container) {
+	rootlessNetworkStateLock.Lock()
+	defer rootlessNetworkStateLock.Unlock()
+	st, ok := rootlessNetworkStates[ctr.ID()]
+	if !ok {
+		return
+	}
+	st.portForwarder = nil
+	if st.requestedIP6 == nil {
+		delete(rootlessNetworkStates, ctr.ID())
+	}
+}
+
+// SetRequestedIP6 requests that ctr's next network setup use ip6 as a
+// one-shot static IPv6 address, the same way a requested IPv4 address or MAC
+// is applied once and then cleared.
+func (c *Container) SetRequestedIP6(ip6 net.IP) {
+	rootlessNetworkStateLock.Lock()
+	defer rootlessNetworkStateLock.Unlock()
+	st, ok := rootlessNetworkStates[c.ID()]
+	if !ok {
+		st = &rootlessNetworkState{}
+		rootlessNetworkStates[c.ID()] = st
+	}
+	st.requestedIP6 = ip6
+}
+
+// takeRequestedIP6 returns ctr's one-shot requested IPv6 address, if any,
+// clearing it so it isn't reused the next time the container starts.
+func takeRequestedIP6(ctr *Container) net.IP {
+	rootlessNetworkStateLock.Lock()
+	defer rootlessNetworkStateLock.Unlock()
+	st, ok := rootlessNetworkStates[ctr.ID()]
+	if !ok {
+		return nil
+	}
+	ip6 := st.requestedIP6
+	st.requestedIP6 = nil
+	if st.portForwarder == nil {
+		delete(rootlessNetworkStates, ctr.ID())
+	}
+	return ip6
+}
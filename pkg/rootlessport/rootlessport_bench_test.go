@@ -0,0 +1,85 @@
+// +build linux
+
+package rootlessport
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/cri-o/ocicni/pkg/ocicni"
+)
+
+// BenchmarkBuiltinDriver measures forwarding through the builtin, in-process
+// PortDriver: each iteration dials a new forwarded TCP connection, echoes a
+// 32 KiB payload through it and closes it, so ns/op includes connection
+// setup. It exists to be compared against the historical exec-based
+// rootlessport path (which forked and re-exec'd /proc/self/exe for every
+// container): compare the reported ns/op and B/op against a checkout that
+// still has the old path.
+func BenchmarkBuiltinDriver(b *testing.B) {
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer echoLn.Close()
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn) // nolint:errcheck
+		}
+	}()
+
+	containerPort := int32(echoLn.Addr().(*net.TCPAddr).Port)
+
+	// Reserve a free host port up front so the benchmark knows what to dial:
+	// the driver itself binds this exact port rather than an OS-chosen one.
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	hostPort := int32(reserved.Addr().(*net.TCPAddr).Port)
+	reserved.Close()
+
+	pm := ocicni.PortMapping{Protocol: "tcp", HostIP: "127.0.0.1", HostPort: hostPort, ContainerPort: containerPort}
+
+	driver, err := NewPortDriver(Config{
+		Mappings: []ocicni.PortMapping{pm},
+		// The current network namespace stands in for a container netns:
+		// this benchmark only measures the forwarding hot path, not netns
+		// entry cost.
+		NetNSPath: "/proc/self/ns/net",
+	}, ioutil.Discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := driver.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer driver.Close()
+
+	payload := make([]byte, 32*1024)
+	resp := make([]byte, len(payload))
+
+	dialAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(hostPort)))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", dialAddr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,723 @@
+// +build linux
+
+// Package rootlessport implements a builtin port forwarder for rootless
+// containers, modeled after RootlessKit's builtin port driver. The
+// forwarding hot path is in-process (PortDriver listens on the host ip:port
+// directly and only crosses into the container's network namespace, via
+// ns.WithNetNSPath, for the lifetime of each forwarded connection), but
+// PortDriver itself runs inside a detached child process re-exec'd from
+// /proc/self/exe: a podman invocation that sets up a container's networking
+// routinely exits (the normal case for `podman run -d`) long before the
+// container itself stops, so the driver can't live in that invocation's
+// process. Parent forks the child, hands it its Config over a pipe, and
+// talks to it afterwards over a small JSON control protocol on a unix
+// socket so AddPort/RemovePort/Close keep working from any later process.
+package rootlessport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/cri-o/ocicni/pkg/ocicni"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ReexecKey is the name the detached port-forwarding child process is
+// re-exec'd under.
+const ReexecKey = "rootlessport"
+
+func init() {
+	reexec.Register(ReexecKey, runChild)
+}
+
+// Config describes the set of port mappings a PortDriver should forward, and
+// the container network namespace it should forward them into.
+type Config struct {
+	// Mappings are the port mappings to start forwarding immediately.
+	Mappings []ocicni.PortMapping
+	// NetNSPath is the path to the container's network namespace.
+	NetNSPath string
+	// ChildIP is the IPv4 literal the driver dials inside the container's
+	// network namespace for IPv4 mappings. Empty means 127.0.0.1.
+	ChildIP string
+	// ChildIP6 is the IPv6 literal the driver dials inside the container's
+	// network namespace for IPv6 mappings. Empty means ::1.
+	ChildIP6 string
+	// EnableIPv6 makes the driver bind the host-side wildcard listener
+	// ("[::]:port") instead of "0.0.0.0:port" for mappings that don't
+	// specify an explicit HostIP.
+	EnableIPv6 bool
+	// TmpDir is used to scope any scratch files the driver needs.
+	TmpDir string
+	// ControlSocket is the path the detached child listens on for
+	// AddPort/RemovePort/quit control requests from Parent.
+	ControlSocket string
+}
+
+// isIPv6 reports whether addr is a literal IPv6 address.
+func isIPv6(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// controlRequest is one JSON control-socket command sent by Parent to the
+// detached child to add or remove a port mapping on its running PortDriver,
+// or ask it to tear down and exit.
+type controlRequest struct {
+	Op      string              `json:"op"`
+	Mapping *ocicni.PortMapping `json:"mapping,omitempty"`
+}
+
+// controlResponse is the JSON reply to a controlRequest.
+type controlResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Parent runs the builtin PortDriver in a detached child process, re-exec'd
+// from /proc/self/exe under ReexecKey, so forwarded ports keep working after
+// the podman invocation that published them exits -- the same guarantee the
+// old exec-based rootlessport process gave, now layered on top of the
+// faster in-process driver instead of replacing process isolation with
+// none.
+type Parent struct {
+	controlSocket string
+}
+
+// NewParent returns a Parent that talks to an already-running detached
+// child's control socket, without needing the Parent value that originally
+// started it. Since controlSocket is deterministic per container (see
+// libpod's rootlessPortControlSocketPath), this lets a later, unrelated
+// podman invocation reattach to a container's port forwarding -- e.g. to
+// hot-(un)publish a port on a container whose `podman run` has already
+// exited.
+func NewParent(controlSocket string) *Parent {
+	return &Parent{controlSocket: controlSocket}
+}
+
+// StartParent forks a detached child process that runs a PortDriver for
+// cfg, waits until the child reports it is listening on every mapping, and
+// then releases the child so it survives this process's exit. logFile
+// receives the child's stdout/stderr.
+func StartParent(cfg Config, logFile *os.File) (*Parent, error) {
+	if cfg.ControlSocket == "" {
+		return nil, errors.New("rootlessport: Config.ControlSocket is required")
+	}
+	if err := os.RemoveAll(cfg.ControlSocket); err != nil {
+		return nil, errors.Wrapf(err, "failed to clear stale control socket %s", cfg.ControlSocket)
+	}
+
+	cfgR, cfgW, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create config pipe")
+	}
+	defer cfgR.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		cfgW.Close()
+		return nil, errors.Wrapf(err, "failed to create ready pipe")
+	}
+	defer readyW.Close()
+	defer readyR.Close()
+
+	cmd := reexec.Command(ReexecKey)
+	cmd.ExtraFiles = []*os.File{cfgR, readyW}
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		cfgW.Close()
+		return nil, errors.Wrapf(err, "failed to start rootlessport child process")
+	}
+	// Only the child holds the ready pipe's write end from here on, so its
+	// exit makes waitReady's read return instead of blocking.
+	readyW.Close()
+
+	if err := json.NewEncoder(cfgW).Encode(&cfg); err != nil {
+		cfgW.Close()
+		killQuietly(cmd)
+		return nil, errors.Wrapf(err, "failed to send config to rootlessport child process")
+	}
+	cfgW.Close()
+
+	if err := waitReady(readyR, cmd); err != nil {
+		killQuietly(cmd)
+		return nil, err
+	}
+
+	if err := cmd.Process.Release(); err != nil {
+		logrus.Errorf("rootlessport: unable to release child process: %v", err)
+	}
+
+	return &Parent{controlSocket: cfg.ControlSocket}, nil
+}
+
+func killQuietly(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		logrus.Errorf("rootlessport: failed to kill child process after setup error: %v", err)
+	}
+}
+
+// waitReady blocks until the child writes its one-byte ready signal to
+// readyR, failing fast if the child process exits first and timing out
+// after 10s so a hung child can't block container startup forever.
+func waitReady(readyR *os.File, cmd *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyR.Read(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Wrapf(err, "rootlessport child process did not become ready")
+		}
+		return nil
+	case <-time.After(10 * time.Second):
+		return errors.New("timed out waiting for rootlessport child process to become ready")
+	}
+}
+
+// control sends req to the child's control socket and returns its response.
+func (p *Parent) control(req controlRequest) error {
+	conn, err := net.Dial("unix", p.controlSocket)
+	if err != nil {
+		return errors.Wrapf(err, "failed to reach rootlessport control socket %s", p.controlSocket)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(&req); err != nil {
+		return errors.Wrapf(err, "failed to send rootlessport control request")
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return errors.Wrapf(err, "failed to read rootlessport control response")
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// AddPort asks the child to start forwarding an additional port mapping.
+func (p *Parent) AddPort(pm ocicni.PortMapping) error {
+	return p.control(controlRequest{Op: "add", Mapping: &pm})
+}
+
+// RemovePort asks the child to stop forwarding a previously added mapping.
+func (p *Parent) RemovePort(pm ocicni.PortMapping) error {
+	return p.control(controlRequest{Op: "remove", Mapping: &pm})
+}
+
+// Close asks the child to stop forwarding and exit, and removes the control
+// socket. It does not wait for the child to actually exit: StartParent
+// already released it from this process.
+func (p *Parent) Close() error {
+	err := p.control(controlRequest{Op: "quit"})
+	if rmErr := os.RemoveAll(p.controlSocket); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// runChild is the rootlessport re-exec entry point. It reads its Config off
+// fd 3, starts a PortDriver, signals readiness on fd 4, and then serves
+// control requests on cfg.ControlSocket until asked to quit.
+func runChild() {
+	cfgFile := os.NewFile(3, "rootlessport-config")
+	readyFile := os.NewFile(4, "rootlessport-ready")
+
+	var cfg Config
+	if err := json.NewDecoder(cfgFile).Decode(&cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "rootlessport: failed to read config: %v\n", err)
+		os.Exit(1)
+	}
+	cfgFile.Close()
+
+	driver, err := NewPortDriver(cfg, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rootlessport: failed to create driver: %v\n", err)
+		os.Exit(1)
+	}
+	if err := driver.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "rootlessport: failed to start driver: %v\n", err)
+		os.Exit(1)
+	}
+
+	ln, err := net.Listen("unix", cfg.ControlSocket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rootlessport: failed to listen on control socket %s: %v\n", cfg.ControlSocket, err)
+		os.Exit(1)
+	}
+
+	if _, err := readyFile.Write([]byte{1}); err != nil {
+		fmt.Fprintf(os.Stderr, "rootlessport: failed to signal readiness: %v\n", err)
+		os.Exit(1)
+	}
+	readyFile.Close()
+
+	serveControl(ln, driver)
+}
+
+// serveControl accepts control connections on ln until a "quit" request is
+// handled, at which point it closes the driver and ln and returns.
+func serveControl(ln net.Listener, driver *PortDriver) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if handleControlConn(conn, driver) {
+			if err := driver.Close(); err != nil {
+				logrus.Errorf("rootlessport: error closing driver: %v", err)
+			}
+			ln.Close()
+			return
+		}
+	}
+}
+
+// handleControlConn services a single control connection and reports
+// whether the child should quit afterwards.
+func handleControlConn(conn net.Conn, driver *PortDriver) (quit bool) {
+	defer conn.Close()
+	var req controlRequest
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = err.Error()
+		json.NewEncoder(conn).Encode(&resp) // nolint:errcheck
+		return false
+	}
+	switch req.Op {
+	case "add":
+		if req.Mapping == nil {
+			resp.Error = "missing mapping for add"
+		} else if err := driver.AddPort(*req.Mapping); err != nil {
+			resp.Error = err.Error()
+		}
+	case "remove":
+		if req.Mapping == nil {
+			resp.Error = "missing mapping for remove"
+		} else if err := driver.RemovePort(*req.Mapping); err != nil {
+			resp.Error = err.Error()
+		}
+	case "quit":
+		quit = true
+	default:
+		resp.Error = fmt.Sprintf("unknown control op %q", req.Op)
+	}
+	json.NewEncoder(conn).Encode(&resp) // nolint:errcheck
+	return quit
+}
+
+// PortDriver is the builtin, in-process RootlessKit-style port forwarder. It
+// is safe for concurrent use.
+type PortDriver struct {
+	mu        sync.Mutex
+	cfg       Config
+	log       io.Writer
+	listeners map[string]io.Closer
+	wg        sync.WaitGroup
+}
+
+// NewPortDriver creates a PortDriver for cfg. log receives a line per
+// forwarding error; successful connections are not logged.
+func NewPortDriver(cfg Config, log io.Writer) (*PortDriver, error) {
+	if log == nil {
+		log = os.Stderr
+	}
+	return &PortDriver{
+		cfg:       cfg,
+		log:       log,
+		listeners: make(map[string]io.Closer),
+	}, nil
+}
+
+func portKey(pm ocicni.PortMapping) string {
+	return fmt.Sprintf("%s:%s:%d:%d", pm.Protocol, pm.HostIP, pm.HostPort, pm.ContainerPort)
+}
+
+func (d *PortDriver) logf(format string, args ...interface{}) {
+	fmt.Fprintf(d.log, format+"\n", args...)
+	logrus.Debugf("rootlessport: "+format, args...)
+}
+
+// Start begins forwarding every port mapping configured in cfg.Mappings.
+func (d *PortDriver) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, pm := range d.cfg.Mappings {
+		if err := d.addPortLocked(pm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ports returns the port mappings currently being forwarded.
+func (d *PortDriver) Ports() []ocicni.PortMapping {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ports := make([]ocicni.PortMapping, 0, len(d.cfg.Mappings))
+	ports = append(ports, d.cfg.Mappings...)
+	return ports
+}
+
+// AddPort starts forwarding an additional port mapping on a running driver.
+func (d *PortDriver) AddPort(pm ocicni.PortMapping) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.listeners[portKey(pm)]; ok {
+		return errors.Errorf("port mapping %s is already being forwarded", portKey(pm))
+	}
+	if err := d.addPortLocked(pm); err != nil {
+		return err
+	}
+	d.cfg.Mappings = append(d.cfg.Mappings, pm)
+	return nil
+}
+
+// RemovePort stops forwarding a previously added port mapping.
+func (d *PortDriver) RemovePort(pm ocicni.PortMapping) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := portKey(pm)
+	l, ok := d.listeners[key]
+	if !ok {
+		return errors.Errorf("no forwarder found for port mapping %s", key)
+	}
+	if err := l.Close(); err != nil {
+		return errors.Wrapf(err, "failed to stop forwarding %s", key)
+	}
+	delete(d.listeners, key)
+	for i, existing := range d.cfg.Mappings {
+		if portKey(existing) == key {
+			d.cfg.Mappings = append(d.cfg.Mappings[:i], d.cfg.Mappings[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Close stops all forwarding and waits for in-flight connections to drain.
+func (d *PortDriver) Close() error {
+	d.mu.Lock()
+	var lastErr error
+	for key, l := range d.listeners {
+		if err := l.Close(); err != nil {
+			lastErr = err
+			d.logf("error closing listener for %s: %v", key, err)
+		}
+		delete(d.listeners, key)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+	return lastErr
+}
+
+// addPortLocked must be called with d.mu held.
+func (d *PortDriver) addPortLocked(pm ocicni.PortMapping) error {
+	hostIP := pm.HostIP
+	if hostIP == "" {
+		hostIP = bindAnyAddr(d.cfg.EnableIPv6)
+	}
+	network := strings.ToLower(pm.Protocol)
+	if network == "" {
+		network = "tcp"
+	}
+	addr := net.JoinHostPort(hostIP, fmt.Sprintf("%d", pm.HostPort))
+
+	switch network {
+	case "tcp":
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to listen on %s", addr)
+		}
+		d.listeners[portKey(pm)] = l
+		d.wg.Add(1)
+		go d.acceptLoop(pm, l)
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to listen on %s", addr)
+		}
+		d.listeners[portKey(pm)] = conn
+		d.wg.Add(1)
+		go d.relayUDP(pm, conn)
+	default:
+		return errors.Errorf("unsupported protocol %q for port mapping", pm.Protocol)
+	}
+	return nil
+}
+
+// bindAnyAddr returns the host-side wildcard address to bind to when no
+// HostIP was specified, choosing between IPv4 and IPv6 wildcards.
+func bindAnyAddr(enableIPv6 bool) string {
+	if enableIPv6 {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// childIPFor returns the literal address the driver should dial inside the
+// container's network namespace for pm, preferring an explicit ChildIP/
+// ChildIP6 and otherwise falling back to the v4/v6 loopback address that
+// matches the mapping's host-side address family.
+func (d *PortDriver) childIPFor(pm ocicni.PortMapping) string {
+	if isIPv6(pm.HostIP) {
+		if d.cfg.ChildIP6 != "" {
+			return d.cfg.ChildIP6
+		}
+		return "::1"
+	}
+	if d.cfg.ChildIP != "" {
+		return d.cfg.ChildIP
+	}
+	return "127.0.0.1"
+}
+
+// acceptLoop accepts inbound TCP connections for pm and hands each one off
+// to handleConn. It returns once l is closed.
+func (d *PortDriver) acceptLoop(pm ocicni.PortMapping, l net.Listener) {
+	defer d.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Listener was closed as part of RemovePort/Close.
+			return
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if err := d.handleConn(pm, conn); err != nil {
+				d.logf("error forwarding connection for %s: %v", portKey(pm), err)
+			}
+		}()
+	}
+}
+
+// handleConn forwards a single accepted TCP connection into the container's
+// network namespace. It hands the host-side connection's file descriptor to
+// a dedicated goroutine running inside the container netns over a
+// SOCK_SEQPACKET socketpair (via SCM_RIGHTS), so that the dial to the
+// container port happens from the correct network namespace without forking
+// a helper process.
+func (d *PortDriver) handleConn(pm ocicni.PortMapping, conn net.Conn) error {
+	defer conn.Close()
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.Errorf("unexpected connection type %T", conn)
+	}
+	connFile, err := tcpConn.File()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get file for accepted connection")
+	}
+	defer connFile.Close()
+
+	sp, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create control socketpair")
+	}
+	parentFile := os.NewFile(uintptr(sp[0]), "rootlessport-parent")
+	childFile := os.NewFile(uintptr(sp[1]), "rootlessport-child")
+	defer parentFile.Close()
+
+	childIP := d.childIPFor(pm)
+	containerPort := pm.ContainerPort
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- childSideRelay(d.cfg.NetNSPath, childFile, childIP, containerPort)
+	}()
+
+	parentConn, err := net.FileConn(parentFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to wrap control socket")
+	}
+	defer parentConn.Close()
+
+	unixConn, ok := parentConn.(*net.UnixConn)
+	if !ok {
+		return errors.Errorf("unexpected control connection type %T", parentConn)
+	}
+	rights := unix.UnixRights(int(connFile.Fd()))
+	if _, _, err := unixConn.WriteMsgUnix(nil, rights, nil); err != nil {
+		return errors.Wrapf(err, "failed to pass connection fd to container netns")
+	}
+
+	return <-errCh
+}
+
+// childSideRelay enters the container's network namespace, receives the
+// host-side connection fd passed over ctrl, dials the container port, and
+// splices bytes between the two sockets until either side is done.
+func childSideRelay(netnsPath string, ctrl *os.File, childIP string, containerPort int32) error {
+	defer ctrl.Close()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	return ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		ctrlConnAny, err := net.FileConn(ctrl)
+		if err != nil {
+			return errors.Wrapf(err, "failed to wrap control socket in container netns")
+		}
+		defer ctrlConnAny.Close()
+		ctrlConn, ok := ctrlConnAny.(*net.UnixConn)
+		if !ok {
+			return errors.Errorf("unexpected control connection type %T", ctrlConnAny)
+		}
+
+		oob := make([]byte, unix.CmsgSpace(4))
+		_, oobn, _, _, err := ctrlConn.ReadMsgUnix(nil, oob)
+		if err != nil {
+			return errors.Wrapf(err, "failed to receive connection fd")
+		}
+		scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse control message")
+		}
+		if len(scms) != 1 {
+			return errors.Errorf("expected exactly one control message, got %d", len(scms))
+		}
+		fds, err := unix.ParseUnixRights(&scms[0])
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse passed rights")
+		}
+		if len(fds) != 1 {
+			return errors.Errorf("expected exactly one passed fd, got %d", len(fds))
+		}
+		hostFile := os.NewFile(uintptr(fds[0]), "rootlessport-hostside")
+		defer hostFile.Close()
+		hostConn, err := net.FileConn(hostFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to wrap passed connection fd")
+		}
+		defer hostConn.Close()
+
+		dialAddr := net.JoinHostPort(childIP, fmt.Sprintf("%d", containerPort))
+		ctrConn, err := net.Dial("tcp", dialAddr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to dial container port %s", dialAddr)
+		}
+		defer ctrConn.Close()
+
+		// Return as soon as one direction finishes; the deferred closes
+		// then unblock the other copy.
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(ctrConn, hostConn) // nolint:errcheck
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(hostConn, ctrConn) // nolint:errcheck
+			done <- struct{}{}
+		}()
+		<-done
+		return nil
+	})
+}
+
+// relayUDP relays datagrams for pm between the host and the container netns.
+// Unlike TCP, UDP has no per-connection accept step, so instead of a single
+// listener-wide dialed socket (which would route every client's replies to
+// whichever client sent last, and race a shared "last client" variable
+// between the read and write goroutines) each distinct remote address gets
+// its own dialed socket into the container netns, tracked in a session
+// table, matching RootlessKit's per-client UDP session handling.
+func (d *PortDriver) relayUDP(pm ocicni.PortMapping, hostConn net.PacketConn) {
+	defer d.wg.Done()
+
+	childIP := d.childIPFor(pm)
+	dialAddr := net.JoinHostPort(childIP, fmt.Sprintf("%d", pm.ContainerPort))
+
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+
+	closeSessions := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for key, conn := range sessions {
+			conn.Close()
+			delete(sessions, key)
+		}
+	}
+
+	buf := make([]byte, 65507)
+	for {
+		n, addr, err := hostConn.ReadFrom(buf)
+		if err != nil {
+			// Listener was closed as part of RemovePort/Close.
+			closeSessions()
+			return
+		}
+
+		key := addr.String()
+		mu.Lock()
+		ctrConn, ok := sessions[key]
+		mu.Unlock()
+		if !ok {
+			var dialErr error
+			err := ns.WithNetNSPath(d.cfg.NetNSPath, func(_ ns.NetNS) error {
+				ctrConn, dialErr = net.Dial("udp", dialAddr)
+				return dialErr
+			})
+			if err != nil {
+				d.logf("error dialing container UDP port %s for client %s: %v", dialAddr, key, err)
+				continue
+			}
+			mu.Lock()
+			sessions[key] = ctrConn
+			mu.Unlock()
+			d.wg.Add(1)
+			go d.relayUDPSession(pm, hostConn, addr, ctrConn, &mu, sessions, key)
+		}
+
+		if _, err := ctrConn.Write(buf[:n]); err != nil {
+			d.logf("error relaying UDP datagram for %s from %s: %v", portKey(pm), key, err)
+		}
+	}
+}
+
+// relayUDPSession copies datagrams read from ctrConn (the session dialed for
+// a single remote client address) back to that client through hostConn,
+// until ctrConn is closed or fails, removing the session from sessions
+// before returning.
+func (d *PortDriver) relayUDPSession(pm ocicni.PortMapping, hostConn net.PacketConn, clientAddr net.Addr, ctrConn net.Conn, mu *sync.Mutex, sessions map[string]net.Conn, key string) {
+	defer d.wg.Done()
+	defer func() {
+		mu.Lock()
+		delete(sessions, key)
+		mu.Unlock()
+		ctrConn.Close()
+	}()
+
+	rbuf := make([]byte, 65507)
+	for {
+		n, err := ctrConn.Read(rbuf)
+		if err != nil {
+			return
+		}
+		if _, err := hostConn.WriteTo(rbuf[:n], clientAddr); err != nil {
+			d.logf("error relaying UDP reply for %s to %s: %v", portKey(pm), key, err)
+			return
+		}
+	}
+}